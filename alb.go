@@ -16,17 +16,19 @@ import (
 // logging
 var albLogger = loggo.GetLogger("alb")
 
-// ALB struct
+// ALB struct. ALB implements LoadBalancer for an Application Load
+// Balancer: host-header/path-pattern rules and HTTP/HTTPS listeners.
 type ALB struct {
 	loadBalancerName string
 	loadBalancerArn  string
 	vpcId            string
 	listeners        []*elbv2.Listener
 	domain           string
+	domains          []string
 	rules            map[string][]*elbv2.Rule
 }
 
-func (a *ALB) init(loadBalancerName string) error {
+func (a *ALB) init(loadBalancerName string, d Deploy) error {
 	a.loadBalancerName = loadBalancerName
 	// retrieve vpcId and loadBalancerArn
 	svc := elbv2.New(session.New())
@@ -71,6 +73,14 @@ func (a *ALB) init(loadBalancerName string) error {
 		return err
 	}
 
+	// converge any declared default listener actions (e.g. "port 80
+	// always redirects to 443") once per ALB, rather than per-rule.
+	if len(d.ListenerActions) > 0 {
+		if err := a.applyListenerActions(d); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -101,9 +111,15 @@ func (a *ALB) getListeners() error {
 	return nil
 }
 
-// get the domain using certificates
+// get the domain(s) using certificates. Unlike a single apex domain, an
+// ALB listener certificate (and any certificates added to it later via
+// AddListenerCertificates, see certs.go) can carry several SANs, and a
+// listener can carry several certificates, so we enumerate all of them
+// across all listeners into a.domains. a.domain is kept as the first
+// domain found, for existing single-domain callers.
 func (a *ALB) getDomainUsingCertificate() error {
 	svc := acm.New(session.New())
+	seen := make(map[string]bool)
 	for _, l := range a.listeners {
 		for _, c := range l.Certificates {
 			albLogger.Debugf("ALB Certificate found with arn: %v", *c.CertificateArn)
@@ -127,17 +143,38 @@ func (a *ALB) getDomainUsingCertificate() error {
 				}
 				return errors.New("Could not describe certificate")
 			}
-			albLogger.Debugf("Domain found through ALB certificate: %v", *result.Certificate.DomainName)
-			s := strings.Split(*result.Certificate.DomainName, ".")
-			if len(s) >= 2 {
-				a.domain = s[len(s)-2] + "." + s[len(s)-1]
+
+			sans := result.Certificate.SubjectAlternativeNames
+			if len(sans) == 0 && result.Certificate.DomainName != nil {
+				sans = []*string{result.Certificate.DomainName}
+			}
+			for _, san := range sans {
+				albLogger.Debugf("Domain found through ALB certificate: %v", *san)
+				s := strings.Split(*san, ".")
+				if len(s) < 2 {
+					continue
+				}
+				domain := s[len(s)-2] + "." + s[len(s)-1]
+				if seen[domain] {
+					continue
+				}
+				seen[domain] = true
+				a.domains = append(a.domains, domain)
+				if a.domain == "" {
+					a.domain = domain
+				}
 			}
-			return nil
 		}
 	}
 	return nil
 }
 
+// getDomains returns every domain ecs-deploy can see a usable
+// certificate for, across every certificate on every listener.
+func (a *ALB) getDomains() []string {
+	return a.domains
+}
+
 func (a *ALB) createTargetGroup(serviceName string, d Deploy) (*string, error) {
 	svc := elbv2.New(session.New())
 	input := &elbv2.CreateTargetGroupInput{
@@ -196,6 +233,13 @@ func (a *ALB) createTargetGroup(serviceName string, d Deploy) (*string, error) {
 	return result.TargetGroups[0].TargetGroupArn, nil
 }
 
+// Deprecated: getHighestRule paginates every rule on listener[0] and
+// returns the highest priority in use, for callers to allocate max+1 on
+// every deploy, which races under concurrent deploys and
+// never reclaims priorities freed by deleted rules. New callers should
+// use ALB.allocateRulePriority (see priority.go), which recovers a
+// redeploy's existing priority from its rule tags and otherwise picks
+// the lowest free slot across all listeners.
 func (a *ALB) getHighestRule() (int64, error) {
 	var highest int64
 	svc := elbv2.New(session.New())
@@ -271,45 +315,69 @@ func (a *ALB) createRuleForListeners(ruleType string, listeners []string, target
 	return retListeners, nil
 }
 
-func (a *ALB) createRule(ruleType string, listenerArn string, targetGroupArn string, rules []string, priority int64) error {
-	svc := elbv2.New(session.New())
-	input := &elbv2.CreateRuleInput{
-		Actions: []*elbv2.Action{
-			{
-				TargetGroupArn: aws.String(targetGroupArn),
-				Type:           aws.String("forward"),
-			},
-		},
-		ListenerArn: aws.String(listenerArn),
-		Priority:    aws.Int64(priority),
+// qualifyHostname turns a bare hostname label into a FQDN by appending
+// domain, e.g. "foo" -> "foo.example.com". If value already looks like a
+// FQDN (it contains a dot), it is returned unchanged: this is how a
+// caller expresses "this rule is for a different apex domain than the
+// ALB's current one" instead of always riding on the ALB's own domain.
+func qualifyHostname(value string, domain string) string {
+	if strings.Contains(value, ".") {
+		return value
 	}
-	if ruleType == "pathPattern" {
+	return value + "." + domain
+}
+
+// hostnameForRule returns the FQDN a "hostname" or "combined" rule would
+// match, validating the rule count first so callers never index rules
+// before it is known to be long enough. It returns "" for rule types
+// with no hostname component (e.g. "pathPattern").
+func hostnameForRule(ruleType string, rules []string, domain string) (string, error) {
+	switch ruleType {
+	case "hostname":
 		if len(rules) != 1 {
-			return errors.New("Wrong number of rules (expected 1, got " + strconv.Itoa(len(rules)) + ")")
+			return "", errors.New("Wrong number of rules (expected 1, got " + strconv.Itoa(len(rules)) + ")")
 		}
-		input.SetConditions([]*elbv2.RuleCondition{
+		return qualifyHostname(rules[0], domain), nil
+	case "combined":
+		if len(rules) != 2 {
+			return "", errors.New("Wrong number of rules (expected 2, got " + strconv.Itoa(len(rules)) + ")")
+		}
+		return qualifyHostname(rules[1], domain), nil
+	case "pathPattern":
+		if len(rules) != 1 {
+			return "", errors.New("Wrong number of rules (expected 1, got " + strconv.Itoa(len(rules)) + ")")
+		}
+		return "", nil
+	default:
+		return "", errors.New("ruleType not recognized: " + ruleType)
+	}
+}
+
+// conditionsForRule builds the ELBv2 rule conditions for a given
+// ruleType ("pathPattern", "hostname" or "combined"). domain is used to
+// qualify bare hostnames into a FQDN, as with LOADBALANCER_DOMAIN.
+func conditionsForRule(ruleType string, rules []string, domain string) ([]*elbv2.RuleCondition, error) {
+	hostname, err := hostnameForRule(ruleType, rules, domain)
+	if err != nil {
+		return nil, err
+	}
+	switch ruleType {
+	case "pathPattern":
+		return []*elbv2.RuleCondition{
 			{
 				Field:  aws.String("path-pattern"),
 				Values: []*string{aws.String(rules[0])},
 			},
-		})
-	} else if ruleType == "hostname" {
-		if len(rules) != 1 {
-			return errors.New("Wrong number of rules (expected 1, got " + strconv.Itoa(len(rules)) + ")")
-		}
-		hostname := rules[0] + "." + getEnv("LOADBALANCER_DOMAIN", a.domain)
-		input.SetConditions([]*elbv2.RuleCondition{
+		}, nil
+	case "hostname":
+		return []*elbv2.RuleCondition{
 			{
 				Field:  aws.String("host-header"),
 				Values: []*string{aws.String(hostname)},
 			},
-		})
-	} else if ruleType == "combined" {
-		if len(rules) != 2 {
-			return errors.New("Wrong number of rules (expected 2, got " + strconv.Itoa(len(rules)) + ")")
-		}
-		hostname := rules[1] + "." + getEnv("LOADBALANCER_DOMAIN", a.domain)
-		input.SetConditions([]*elbv2.RuleCondition{
+		}, nil
+	case "combined":
+		return []*elbv2.RuleCondition{
 			{
 				Field:  aws.String("path-pattern"),
 				Values: []*string{aws.String(rules[0])},
@@ -318,17 +386,49 @@ func (a *ALB) createRule(ruleType string, listenerArn string, targetGroupArn str
 				Field:  aws.String("host-header"),
 				Values: []*string{aws.String(hostname)},
 			},
-		})
-	} else {
-		return errors.New("ruleType not recognized: " + ruleType)
+		}, nil
+	default:
+		return nil, errors.New("ruleType not recognized: " + ruleType)
 	}
+}
 
-	_, err := svc.CreateRule(input)
+func (a *ALB) createRule(ruleType string, listenerArn string, targetGroupArn string, rules []string, priority int64) error {
+	svc := elbv2.New(session.New())
+	domain := getEnv("LOADBALANCER_DOMAIN", a.domain)
+	if getEnv("LOADBALANCER_DOMAIN", "") == "" {
+		hostname, err := hostnameForRule(ruleType, rules, domain)
+		if err != nil {
+			return err
+		}
+		if hostname != "" {
+			if err := a.ensureCertificateForHostname(hostname); err != nil {
+				return err
+			}
+		}
+	}
+	conditions, err := conditionsForRule(ruleType, rules, domain)
+	if err != nil {
+		return err
+	}
+	input := &elbv2.CreateRuleInput{
+		Actions: []*elbv2.Action{
+			{
+				TargetGroupArn: aws.String(targetGroupArn),
+				Type:           aws.String("forward"),
+			},
+		},
+		ListenerArn: aws.String(listenerArn),
+		Priority:    aws.Int64(priority),
+		Conditions:  conditions,
+	}
+
+	_, err = svc.CreateRule(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case elbv2.ErrCodePriorityInUseException:
 				albLogger.Errorf(elbv2.ErrCodePriorityInUseException+": %v", aerr.Error())
+				return errPriorityInUse
 			case elbv2.ErrCodeTooManyTargetGroupsException:
 				albLogger.Errorf(elbv2.ErrCodeTooManyTargetGroupsException+": %v", aerr.Error())
 			case elbv2.ErrCodeTooManyRulesException:
@@ -360,6 +460,12 @@ func (a *ALB) createRule(ruleType string, listenerArn string, targetGroupArn str
 	return nil
 }
 
+// errPriorityInUse is returned by createRule when AWS rejects the create
+// because another rule already holds the requested priority, so callers
+// like ALB.createRuleForService can distinguish "raced by a concurrent
+// deploy" from other failures and retry.
+var errPriorityInUse = errors.New("alb rule priority already in use")
+
 // get rules by listener
 func (a *ALB) getRulesForAllListeners() error {
 	a.rules = make(map[string][]*elbv2.Rule)
@@ -368,26 +474,35 @@ func (a *ALB) getRulesForAllListeners() error {
 	for _, l := range a.listeners {
 		input := &elbv2.DescribeRulesInput{ListenerArn: aws.String(*l.ListenerArn)}
 
+		c := true // parse more pages if c is true
 		result, err := svc.DescribeRules(input)
-		if err != nil {
-			if aerr, ok := err.(awserr.Error); ok {
-				switch aerr.Code() {
-				case elbv2.ErrCodeListenerNotFoundException:
-					albLogger.Errorf(elbv2.ErrCodeListenerNotFoundException+": %v", aerr.Error())
-				case elbv2.ErrCodeRuleNotFoundException:
-					albLogger.Errorf(elbv2.ErrCodeRuleNotFoundException+": %v", aerr.Error())
-				default:
-					albLogger.Errorf(aerr.Error())
+		for c {
+			if err != nil {
+				if aerr, ok := err.(awserr.Error); ok {
+					switch aerr.Code() {
+					case elbv2.ErrCodeListenerNotFoundException:
+						albLogger.Errorf(elbv2.ErrCodeListenerNotFoundException+": %v", aerr.Error())
+					case elbv2.ErrCodeRuleNotFoundException:
+						albLogger.Errorf(elbv2.ErrCodeRuleNotFoundException+": %v", aerr.Error())
+					default:
+						albLogger.Errorf(aerr.Error())
+					}
+				} else {
+					albLogger.Errorf(err.Error())
 				}
-			} else {
-				albLogger.Errorf(err.Error())
+				return errors.New("Could not get Listeners for loadbalancer")
 			}
-			return errors.New("Could not get Listeners for loadbalancer")
-		}
-		for _, r := range result.Rules {
-			a.rules[*l.ListenerArn] = append(a.rules[*l.ListenerArn], r)
-			if len(r.Conditions) != 0 && len(r.Conditions[0].Values) != 0 {
-				albLogger.Debugf("Importing rule: %+v", *r.Conditions[0].Values[0])
+			for _, r := range result.Rules {
+				a.rules[*l.ListenerArn] = append(a.rules[*l.ListenerArn], r)
+				if len(r.Conditions) != 0 && len(r.Conditions[0].Values) != 0 {
+					albLogger.Debugf("Importing rule: %+v", *r.Conditions[0].Values[0])
+				}
+			}
+			if result.NextMarker == nil || len(*result.NextMarker) == 0 {
+				c = false
+			} else {
+				input.SetMarker(*result.NextMarker)
+				result, err = svc.DescribeRules(input)
 			}
 		}
 	}
@@ -428,40 +543,22 @@ func (a *ALB) getTargetGroupArn(serviceName string) (*string, error) {
 func (a *ALB) getDomain() string {
 	return getEnv("LOADBALANCER_DOMAIN", a.domain)
 }
+
+// findRule looks up the rule on listener whose forward action targets
+// targetGroupArn and whose conditions match the given (field, value)
+// pairs. It matches on the same richer condition set createRuleAdvanced
+// can create (see findRuleByConditions in rule_conditions.go); fields
+// that need more than a single value (http-header's header name,
+// query-string's key/value pairs) aren't representable through this
+// plain-string-pairs signature, so callers needing those should use
+// findRuleByConditions directly with a RuleCondition.
 func (a *ALB) findRule(listener string, targetGroupArn string, conditionField []string, conditionValue []string) (*string, *string, error) {
 	if len(conditionField) != len(conditionValue) {
 		return nil, nil, errors.New("conditionField length not equal to conditionValue length")
 	}
-	// examine rules
-	if rules, ok := a.rules[listener]; ok {
-		for _, r := range rules {
-			for _, a := range r.Actions {
-				if *a.Type == "forward" && *a.TargetGroupArn == targetGroupArn {
-					// target group found, loop over conditions
-					priorityFound := false
-					skip := false
-					for _, c := range r.Conditions {
-						match := false
-						for i, _ := range conditionField {
-							if *c.Field == conditionField[i] && len(c.Values) > 0 && *c.Values[0] == conditionValue[i] {
-								match = true
-							}
-						}
-						if !skip && match { // if any condition was false, skip this rule
-							priorityFound = true
-						} else {
-							priorityFound = false
-							skip = true
-						}
-					}
-					if priorityFound {
-						return r.RuleArn, r.Priority, nil
-					}
-				}
-			}
-		}
-	} else {
-		return nil, nil, errors.New("Listener not found in rule list")
+	conditions := make([]RuleCondition, len(conditionField))
+	for i := range conditionField {
+		conditions[i] = RuleCondition{Field: conditionField[i], Values: []string{conditionValue[i]}}
 	}
-	return nil, nil, errors.New("Priority not found for rule: listener " + listener + ", targetGroupArn: " + targetGroupArn + ", Field: " + strings.Join(conditionField, ",") + ", Value: " + strings.Join(conditionValue, ","))
+	return a.findRuleByConditions(listener, targetGroupArn, conditions)
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/acm"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+
+	"errors"
+	"strings"
+)
+
+// domainOf returns the apex domain (last two labels) of a hostname, e.g.
+// "foo.example.com" -> "example.com".
+func domainOf(hostname string) string {
+	s := strings.Split(hostname, ".")
+	if len(s) < 2 {
+		return hostname
+	}
+	return s[len(s)-2] + "." + s[len(s)-1]
+}
+
+// ensureCertificateForHostname makes sure an HTTPS listener can serve
+// hostname: if hostname's domain is already in a.getDomains(), this is a
+// no-op; otherwise it looks for an issued ACM certificate covering that
+// domain and attaches it to every HTTPS listener via
+// AddListenerCertificates, so one ALB can terminate many domains without
+// manual listener editing.
+func (a *ALB) ensureCertificateForHostname(hostname string) error {
+	domain := domainOf(hostname)
+	for _, d := range a.domains {
+		if d == domain {
+			return nil
+		}
+	}
+
+	certArn, err := findAcmCertificateForDomain(domain)
+	if err != nil {
+		return err
+	}
+	if certArn == "" {
+		return errors.New("No ACM certificate found for domain: " + domain)
+	}
+
+	svc := elbv2.New(session.New())
+	for _, l := range a.listeners {
+		if l.Protocol == nil || !strings.EqualFold(*l.Protocol, "HTTPS") {
+			continue
+		}
+		_, err := svc.AddListenerCertificates(&elbv2.AddListenerCertificatesInput{
+			ListenerArn: l.ListenerArn,
+			Certificates: []*elbv2.Certificate{
+				{CertificateArn: aws.String(certArn)},
+			},
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				switch aerr.Code() {
+				case elbv2.ErrCodeTooManyCertificatesException:
+					albLogger.Errorf(elbv2.ErrCodeTooManyCertificatesException+": %v", aerr.Error())
+				case elbv2.ErrCodeCertificateNotFoundException:
+					albLogger.Errorf(elbv2.ErrCodeCertificateNotFoundException+": %v", aerr.Error())
+				case elbv2.ErrCodeListenerNotFoundException:
+					albLogger.Errorf(elbv2.ErrCodeListenerNotFoundException+": %v", aerr.Error())
+				default:
+					albLogger.Errorf(aerr.Error())
+				}
+			} else {
+				albLogger.Errorf(err.Error())
+			}
+			return errors.New("Could not add listener certificate for domain " + domain)
+		}
+		albLogger.Infof("Attached ACM certificate %s (domain %s) to listener %s", certArn, domain, *l.ListenerArn)
+	}
+
+	a.domains = append(a.domains, domain)
+	return nil
+}
+
+// findAcmCertificateForDomain searches issued ACM certificates for one
+// whose domain name or SANs cover domain, returning its ARN, or "" if
+// none is found.
+func findAcmCertificateForDomain(domain string) (string, error) {
+	svc := acm.New(session.New())
+	input := &acm.ListCertificatesInput{
+		CertificateStatuses: []*string{aws.String(acm.CertificateStatusIssued)},
+	}
+
+	var found string
+	err := svc.ListCertificatesPages(input, func(page *acm.ListCertificatesOutput, lastPage bool) bool {
+		for _, summary := range page.CertificateSummaryList {
+			if certificateCoversDomain(summary, domain) {
+				found = *summary.CertificateArn
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			albLogger.Errorf(aerr.Error())
+		} else {
+			albLogger.Errorf(err.Error())
+		}
+		return "", errors.New("Could not list ACM certificates")
+	}
+	return found, nil
+}
+
+// certificateCoversDomain reports whether summary's primary domain name
+// or any of its SubjectAlternativeNameSummaries cover domain. ACM's
+// ListCertificates response includes SANs directly, with no extra
+// DescribeCertificate call needed, so a single multi-SAN certificate
+// terminating many domains on one ALB can still be found from its SANs
+// alone.
+func certificateCoversDomain(summary *acm.CertificateSummary, domain string) bool {
+	if summary.DomainName != nil && (domainOf(*summary.DomainName) == domain || *summary.DomainName == domain) {
+		return true
+	}
+	for _, san := range summary.SubjectAlternativeNameSummaries {
+		if san != nil && (domainOf(*san) == domain || *san == domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/acm"
+)
+
+func TestDomainOfStripsSubdomain(t *testing.T) {
+	if got := domainOf("foo.example.com"); got != "example.com" {
+		t.Fatalf("expected example.com, got %s", got)
+	}
+	if got := domainOf("example.com"); got != "example.com" {
+		t.Fatalf("expected a bare domain to pass through unchanged, got %s", got)
+	}
+}
+
+func TestCertificateCoversDomainMatchesPrimaryDomainName(t *testing.T) {
+	summary := &acm.CertificateSummary{
+		CertificateArn: aws.String("arn:cert-1"),
+		DomainName:     aws.String("example.com"),
+	}
+	if !certificateCoversDomain(summary, "example.com") {
+		t.Fatal("expected a matching primary domain name to cover the domain")
+	}
+	if certificateCoversDomain(summary, "other.com") {
+		t.Fatal("did not expect an unrelated domain to match")
+	}
+}
+
+func TestCertificateCoversDomainMatchesSubjectAlternativeName(t *testing.T) {
+	summary := &acm.CertificateSummary{
+		CertificateArn: aws.String("arn:cert-1"),
+		DomainName:     aws.String("primary.com"),
+		SubjectAlternativeNameSummaries: []*string{
+			aws.String("foo.other.com"),
+			aws.String("bar.other.com"),
+		},
+	}
+	if !certificateCoversDomain(summary, "other.com") {
+		t.Fatal("expected a domain only covered by a SAN to still match")
+	}
+	if certificateCoversDomain(summary, "unrelated.com") {
+		t.Fatal("did not expect a domain absent from both DomainName and SANs to match")
+	}
+}
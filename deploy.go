@@ -0,0 +1,43 @@
+package main
+
+// HealthCheck describes the target group health check for a service.
+type HealthCheck struct {
+	HealthyThreshold   int64
+	UnhealthyThreshold int64
+	Path               string
+	Port               string
+	Protocol           string
+	Interval           int64
+	Matcher            string
+	Timeout            int64
+}
+
+// Deploy describes a single service deployment.
+type Deploy struct {
+	ServiceName     string
+	ServicePort     int64
+	ServiceProtocol string
+	HealthCheck     HealthCheck
+
+	// LoadBalancerType selects which LoadBalancer implementation the
+	// service is deployed behind: "application" (default) or "network".
+	LoadBalancerType string
+
+	// TargetType is the ELBv2 target group target type ("instance" or
+	// "ip"). Only meaningful when LoadBalancerType is "network"; ALB
+	// target groups are always "instance" today.
+	TargetType string
+
+	// Strategy controls how traffic is moved onto a new deployment:
+	// "rolling" (default, in-place task replacement, no ALB-side
+	// orchestration needed) or "blue-green"/"canary" (ALB.rollout stands
+	// up a second "green" target group, shifts weight onto it step by
+	// step via ALB.shiftTraffic, then deregisters the old one). See
+	// ALB.rollout for what it does and does not cover.
+	Strategy string
+
+	// ListenerActions declares default listener actions to converge
+	// once per ALB (e.g. "port 80 always redirects to 443"), rather than
+	// per-rule. See ALB.applyListenerActions.
+	ListenerActions []ListenerAction
+}
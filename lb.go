@@ -0,0 +1,46 @@
+package main
+
+// LoadBalancerTypeApplication and LoadBalancerTypeNetwork are the values
+// accepted for Deploy.LoadBalancerType.
+const (
+	LoadBalancerTypeApplication = "application"
+	LoadBalancerTypeNetwork     = "network"
+)
+
+// LoadBalancer abstracts over the ELBv2 load balancer types ecs-deploy can
+// deploy a service behind. ALB implements the Application Load Balancer
+// semantics (host-header/path-pattern rules, HTTP/HTTPS), while NLB
+// implements the Network Load Balancer semantics (TCP/TLS/UDP listeners,
+// no layer-7 routing).
+type LoadBalancer interface {
+	init(loadBalancerName string, d Deploy) error
+	createTargetGroup(serviceName string, d Deploy) (*string, error)
+	createRuleForAllListeners(ruleType string, targetGroupArn string, rules []string, priority int64) ([]string, error)
+	getDomainUsingCertificate() error
+	getDomain() string
+	getTargetGroupArn(serviceName string) (*string, error)
+}
+
+// newLoadBalancer returns the LoadBalancer implementation for the given
+// Deploy.LoadBalancerType. An empty loadBalancerType defaults to an ALB,
+// to preserve existing deploy payloads.
+func newLoadBalancer(loadBalancerType string) LoadBalancer {
+	switch loadBalancerType {
+	case LoadBalancerTypeNetwork:
+		return &NLB{}
+	default:
+		return &ALB{}
+	}
+}
+
+// initLoadBalancer is the entry point a deploy should use to get its
+// LoadBalancer: it picks ALB or NLB from d.LoadBalancerType (so a
+// deploy payload with `loadBalancerType: network` actually ends up
+// behind an NLB) and initializes it against loadBalancerName.
+func initLoadBalancer(loadBalancerName string, d Deploy) (LoadBalancer, error) {
+	lb := newLoadBalancer(d.LoadBalancerType)
+	if err := lb.init(loadBalancerName, d); err != nil {
+		return nil, err
+	}
+	return lb, nil
+}
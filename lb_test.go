@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestNewLoadBalancerNetworkReturnsNLB(t *testing.T) {
+	lb := newLoadBalancer(LoadBalancerTypeNetwork)
+	if _, ok := lb.(*NLB); !ok {
+		t.Fatalf("expected *NLB for loadBalancerType %q, got %T", LoadBalancerTypeNetwork, lb)
+	}
+}
+
+func TestNewLoadBalancerDefaultsToALB(t *testing.T) {
+	for _, loadBalancerType := range []string{"", LoadBalancerTypeApplication, "bogus"} {
+		lb := newLoadBalancer(loadBalancerType)
+		if _, ok := lb.(*ALB); !ok {
+			t.Fatalf("expected *ALB for loadBalancerType %q, got %T", loadBalancerType, lb)
+		}
+	}
+}
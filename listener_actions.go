@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+
+	"errors"
+	"strings"
+)
+
+// ListenerAction describes a default action to converge onto a
+// listener, for action types createRule's plain "forward" doesn't cover:
+// "redirect" (e.g. HTTP -> HTTPS) and "fixed-response" (e.g. a
+// maintenance-mode page). Declared once per listener in a Deploy via
+// Deploy.ListenerActions and converged by ALB.applyListenerActions on
+// init, rather than per-rule.
+type ListenerAction struct {
+	// Protocol selects which listener(s) this action applies to, e.g.
+	// "HTTP" or "HTTPS".
+	Protocol string
+	// Type is "redirect" or "fixed-response".
+	Type string
+
+	// Redirect fields, used when Type is "redirect".
+	RedirectStatusCode string // "HTTP_301" or "HTTP_302"
+	RedirectProtocol   string // e.g. "HTTPS"; "#{protocol}" keeps it unchanged
+	RedirectPort       string // e.g. "443"; "#{port}" keeps it unchanged
+	RedirectHost       string // defaults to "#{host}"
+	RedirectPath       string // defaults to "/#{path}"
+	RedirectQuery      string // defaults to "#{query}"
+
+	// Fixed-response fields, used when Type is "fixed-response".
+	FixedResponseStatusCode  string
+	FixedResponseContentType string
+	FixedResponseMessageBody string
+}
+
+// buildAction converts a ListenerAction into the elbv2 API shape.
+func buildAction(la ListenerAction) (*elbv2.Action, error) {
+	switch la.Type {
+	case "redirect":
+		statusCode := la.RedirectStatusCode
+		if statusCode == "" {
+			statusCode = "HTTP_301"
+		}
+		cfg := &elbv2.RedirectActionConfig{StatusCode: aws.String(statusCode)}
+		if la.RedirectProtocol != "" {
+			cfg.Protocol = aws.String(la.RedirectProtocol)
+		}
+		if la.RedirectPort != "" {
+			cfg.Port = aws.String(la.RedirectPort)
+		}
+		cfg.Host = aws.String(orDefault(la.RedirectHost, "#{host}"))
+		cfg.Path = aws.String(orDefault(la.RedirectPath, "/#{path}"))
+		cfg.Query = aws.String(orDefault(la.RedirectQuery, "#{query}"))
+		return &elbv2.Action{
+			Type:           aws.String("redirect"),
+			RedirectConfig: cfg,
+		}, nil
+	case "fixed-response":
+		if la.FixedResponseStatusCode == "" {
+			return nil, errors.New("fixed-response listener action requires FixedResponseStatusCode")
+		}
+		cfg := &elbv2.FixedResponseActionConfig{
+			StatusCode: aws.String(la.FixedResponseStatusCode),
+		}
+		if la.FixedResponseContentType != "" {
+			cfg.ContentType = aws.String(la.FixedResponseContentType)
+		}
+		if la.FixedResponseMessageBody != "" {
+			cfg.MessageBody = aws.String(la.FixedResponseMessageBody)
+		}
+		return &elbv2.Action{
+			Type:                aws.String("fixed-response"),
+			FixedResponseConfig: cfg,
+		}, nil
+	default:
+		return nil, errors.New("listener action type not recognized: " + la.Type)
+	}
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// applyListenerActions converges every ListenerAction in d onto the
+// matching listener(s)' default action, by protocol. ALB.init calls it
+// whenever d.ListenerActions is non-empty, e.g. to make port 80 always
+// redirect to 443, rather than it being applied per rule.
+func (a *ALB) applyListenerActions(d Deploy) error {
+	svc := elbv2.New(session.New())
+	for _, la := range d.ListenerActions {
+		action, err := buildAction(la)
+		if err != nil {
+			return err
+		}
+		for _, l := range a.listeners {
+			if l.Protocol == nil || !strings.EqualFold(*l.Protocol, la.Protocol) {
+				continue
+			}
+			_, err := svc.ModifyListener(&elbv2.ModifyListenerInput{
+				ListenerArn:    l.ListenerArn,
+				DefaultActions: []*elbv2.Action{action},
+			})
+			if err != nil {
+				if aerr, ok := err.(awserr.Error); ok {
+					albLogger.Errorf(aerr.Error())
+				} else {
+					albLogger.Errorf(err.Error())
+				}
+				return errors.New("Could not apply listener action for protocol " + la.Protocol)
+			}
+			albLogger.Infof("Converged default action (%s) on %s listener %s", la.Type, la.Protocol, *l.ListenerArn)
+		}
+	}
+	return nil
+}
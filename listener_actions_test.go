@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestOrDefault(t *testing.T) {
+	if got := orDefault("", "fallback"); got != "fallback" {
+		t.Fatalf("expected fallback, got %s", got)
+	}
+	if got := orDefault("value", "fallback"); got != "value" {
+		t.Fatalf("expected value to be preserved, got %s", got)
+	}
+}
+
+func TestBuildActionRedirectDefaults(t *testing.T) {
+	action, err := buildAction(ListenerAction{Type: "redirect"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg := action.RedirectConfig
+	if *cfg.StatusCode != "HTTP_301" {
+		t.Fatalf("expected default status code HTTP_301, got %s", *cfg.StatusCode)
+	}
+	if *cfg.Host != "#{host}" || *cfg.Path != "/#{path}" || *cfg.Query != "#{query}" {
+		t.Fatalf("expected default host/path/query passthrough, got host=%s path=%s query=%s", *cfg.Host, *cfg.Path, *cfg.Query)
+	}
+	if cfg.Protocol != nil || cfg.Port != nil {
+		t.Fatalf("did not expect Protocol/Port to be set when not given")
+	}
+}
+
+func TestBuildActionRedirectOverrides(t *testing.T) {
+	action, err := buildAction(ListenerAction{
+		Type:               "redirect",
+		RedirectStatusCode: "HTTP_302",
+		RedirectProtocol:   "HTTPS",
+		RedirectPort:       "443",
+		RedirectHost:       "other.example.com",
+		RedirectPath:       "/new",
+		RedirectQuery:      "a=b",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg := action.RedirectConfig
+	if *cfg.StatusCode != "HTTP_302" || *cfg.Protocol != "HTTPS" || *cfg.Port != "443" {
+		t.Fatalf("expected overrides to be applied, got %+v", cfg)
+	}
+	if *cfg.Host != "other.example.com" || *cfg.Path != "/new" || *cfg.Query != "a=b" {
+		t.Fatalf("expected overrides to be applied, got host=%s path=%s query=%s", *cfg.Host, *cfg.Path, *cfg.Query)
+	}
+}
+
+func TestBuildActionFixedResponseRequiresStatusCode(t *testing.T) {
+	if _, err := buildAction(ListenerAction{Type: "fixed-response"}); err == nil {
+		t.Fatal("expected an error when FixedResponseStatusCode is missing")
+	}
+}
+
+func TestBuildActionFixedResponse(t *testing.T) {
+	action, err := buildAction(ListenerAction{
+		Type:                     "fixed-response",
+		FixedResponseStatusCode:  "503",
+		FixedResponseContentType: "text/plain",
+		FixedResponseMessageBody: "down for maintenance",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg := action.FixedResponseConfig
+	if *cfg.StatusCode != "503" || *cfg.ContentType != "text/plain" || *cfg.MessageBody != "down for maintenance" {
+		t.Fatalf("unexpected fixed-response config: %+v", cfg)
+	}
+}
+
+func TestBuildActionUnrecognizedType(t *testing.T) {
+	if _, err := buildAction(ListenerAction{Type: "bogus"}); err == nil {
+		t.Fatal("expected an error for an unrecognized listener action type")
+	}
+}
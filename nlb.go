@@ -0,0 +1,304 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/acm"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/juju/loggo"
+
+	"errors"
+	"strings"
+)
+
+// logging
+var nlbLogger = loggo.GetLogger("nlb")
+
+// NLB struct. A Network Load Balancer operates at layer 4: it has no
+// host-header/path-pattern rules, so a listener forwards everything it
+// receives to a single target group.
+type NLB struct {
+	loadBalancerName string
+	loadBalancerArn  string
+	vpcId            string
+	listeners        []*elbv2.Listener
+	domain           string
+}
+
+// init retrieves the Network Load Balancer's ARN, listeners and domain.
+// d is accepted to satisfy the LoadBalancer interface; NLB has no
+// layer-7 default actions to converge (redirect/fixed-response are ALB
+// concepts), so d.ListenerActions is ignored here.
+func (n *NLB) init(loadBalancerName string, d Deploy) error {
+	n.loadBalancerName = loadBalancerName
+	svc := elbv2.New(session.New())
+	input := &elbv2.DescribeLoadBalancersInput{
+		Names: []*string{
+			aws.String(loadBalancerName),
+		},
+	}
+
+	result, err := svc.DescribeLoadBalancers(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case elbv2.ErrCodeLoadBalancerNotFoundException:
+				nlbLogger.Errorf(elbv2.ErrCodeLoadBalancerNotFoundException+": %v", aerr.Error())
+			default:
+				nlbLogger.Errorf(aerr.Error())
+			}
+		} else {
+			nlbLogger.Errorf(err.Error())
+		}
+		return errors.New("Could not describe loadbalancer")
+	} else if len(result.LoadBalancers) == 0 {
+		return errors.New("Could not describe loadbalancer (no elements returned)")
+	}
+	n.loadBalancerArn = *result.LoadBalancers[0].LoadBalancerArn
+	n.loadBalancerName = *result.LoadBalancers[0].LoadBalancerName
+	n.vpcId = *result.LoadBalancers[0].VpcId
+
+	err = n.getListeners()
+	if err != nil {
+		return err
+	}
+	err = n.getDomainUsingCertificate()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// get the listeners for the loadbalancer
+func (n *NLB) getListeners() error {
+	svc := elbv2.New(session.New())
+	input := &elbv2.DescribeListenersInput{LoadBalancerArn: aws.String(n.loadBalancerArn)}
+
+	result, err := svc.DescribeListeners(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case elbv2.ErrCodeListenerNotFoundException:
+				nlbLogger.Errorf(elbv2.ErrCodeListenerNotFoundException+": %v", aerr.Error())
+			case elbv2.ErrCodeLoadBalancerNotFoundException:
+				nlbLogger.Errorf(elbv2.ErrCodeLoadBalancerNotFoundException+": %v", aerr.Error())
+			default:
+				nlbLogger.Errorf(aerr.Error())
+			}
+		} else {
+			nlbLogger.Errorf(err.Error())
+		}
+		return errors.New("Could not get Listeners for loadbalancer")
+	}
+	for _, l := range result.Listeners {
+		n.listeners = append(n.listeners, l)
+	}
+	return nil
+}
+
+// get the domain from the first certificate found on any listener; other
+// certificates are not read
+func (n *NLB) getDomainUsingCertificate() error {
+	svc := acm.New(session.New())
+	for _, l := range n.listeners {
+		for _, c := range l.Certificates {
+			nlbLogger.Debugf("NLB Certificate found with arn: %v", *c.CertificateArn)
+			input := &acm.DescribeCertificateInput{
+				CertificateArn: c.CertificateArn,
+			}
+
+			result, err := svc.DescribeCertificate(input)
+			if err != nil {
+				if aerr, ok := err.(awserr.Error); ok {
+					switch aerr.Code() {
+					case acm.ErrCodeResourceNotFoundException:
+						nlbLogger.Errorf(acm.ErrCodeResourceNotFoundException+": %v", aerr.Error())
+					case acm.ErrCodeInvalidArnException:
+						nlbLogger.Errorf(acm.ErrCodeInvalidArnException+": %v", aerr.Error())
+					default:
+						nlbLogger.Errorf(aerr.Error())
+					}
+				} else {
+					nlbLogger.Errorf(err.Error())
+				}
+				return errors.New("Could not describe certificate")
+			}
+			nlbLogger.Debugf("Domain found through NLB certificate: %v", *result.Certificate.DomainName)
+			s := strings.Split(*result.Certificate.DomainName, ".")
+			if len(s) >= 2 {
+				n.domain = s[len(s)-2] + "." + s[len(s)-1]
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// createTargetGroup creates an NLB target group. Unlike an ALB target
+// group, the protocol is one of TCP/TLS/UDP/TCP_UDP and the target type
+// (ip or instance) must be set explicitly; health checks on a TCP target
+// group may only use TCP/HTTP/HTTPS as the health check protocol.
+func (n *NLB) createTargetGroup(serviceName string, d Deploy) (*string, error) {
+	svc := elbv2.New(session.New())
+	targetType := d.TargetType
+	if targetType == "" {
+		targetType = "instance"
+	}
+	input := &elbv2.CreateTargetGroupInput{
+		Name:       aws.String(serviceName),
+		VpcId:      aws.String(n.vpcId),
+		Port:       aws.Int64(d.ServicePort),
+		Protocol:   aws.String(d.ServiceProtocol),
+		TargetType: aws.String(targetType),
+	}
+	if d.HealthCheck.HealthyThreshold != 0 {
+		input.SetHealthyThresholdCount(d.HealthCheck.HealthyThreshold)
+	}
+	if d.HealthCheck.UnhealthyThreshold != 0 {
+		input.SetUnhealthyThresholdCount(d.HealthCheck.UnhealthyThreshold)
+	}
+	if d.HealthCheck.Path != "" {
+		input.SetHealthCheckPath(d.HealthCheck.Path)
+	}
+	if d.HealthCheck.Port != "" {
+		input.SetHealthCheckPort(d.HealthCheck.Port)
+	}
+	if d.HealthCheck.Protocol != "" {
+		input.SetHealthCheckProtocol(d.HealthCheck.Protocol)
+	}
+	if d.HealthCheck.Interval != 0 {
+		input.SetHealthCheckIntervalSeconds(d.HealthCheck.Interval)
+	}
+	if d.HealthCheck.Timeout > 0 {
+		input.SetHealthCheckTimeoutSeconds(d.HealthCheck.Timeout)
+	}
+
+	result, err := svc.CreateTargetGroup(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case elbv2.ErrCodeDuplicateTargetGroupNameException:
+				nlbLogger.Errorf(elbv2.ErrCodeDuplicateTargetGroupNameException+": %v", aerr.Error())
+			case elbv2.ErrCodeTooManyTargetGroupsException:
+				nlbLogger.Errorf(elbv2.ErrCodeTooManyTargetGroupsException+": %v", aerr.Error())
+			case elbv2.ErrCodeInvalidConfigurationRequestException:
+				nlbLogger.Errorf(elbv2.ErrCodeInvalidConfigurationRequestException+": %v", aerr.Error())
+			default:
+				nlbLogger.Errorf(aerr.Error())
+			}
+		} else {
+			nlbLogger.Errorf(err.Error())
+		}
+		return nil, errors.New("Could not create target group")
+	} else if len(result.TargetGroups) == 0 {
+		return nil, errors.New("Could not create target group (target group list is empty)")
+	}
+
+	targetGroupArn := result.TargetGroups[0].TargetGroupArn
+	if err := n.setTargetGroupAttributes(*targetGroupArn, d); err != nil {
+		return nil, err
+	}
+	return targetGroupArn, nil
+}
+
+// setTargetGroupAttributes applies NLB-specific target group attributes:
+// a 30 second deregistration delay and, for instance targets,
+// preservation of the client's source IP. Cross-zone load balancing is
+// not set here.
+func (n *NLB) setTargetGroupAttributes(targetGroupArn string, d Deploy) error {
+	svc := elbv2.New(session.New())
+	attrs := []*elbv2.TargetGroupAttribute{
+		{
+			Key:   aws.String("deregistration_delay.timeout_seconds"),
+			Value: aws.String("30"),
+		},
+	}
+	if d.TargetType == "" || d.TargetType == "instance" {
+		attrs = append(attrs, &elbv2.TargetGroupAttribute{
+			Key:   aws.String("preserve_client_ip.enabled"),
+			Value: aws.String("true"),
+		})
+	}
+	input := &elbv2.ModifyTargetGroupAttributesInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+		Attributes:     attrs,
+	}
+	_, err := svc.ModifyTargetGroupAttributes(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			nlbLogger.Errorf(aerr.Error())
+		} else {
+			nlbLogger.Errorf(err.Error())
+		}
+		return errors.New("Could not set target group attributes")
+	}
+	return nil
+}
+
+// createRuleForAllListeners has no true equivalent on an NLB: there is no
+// rule engine, only a single default action per listener. We treat the
+// "rule" as a request to make targetGroupArn the listener's default
+// forward action, and ignore ruleType/rules/priority.
+func (n *NLB) createRuleForAllListeners(ruleType string, targetGroupArn string, rules []string, priority int64) ([]string, error) {
+	svc := elbv2.New(session.New())
+	var listeners []string
+	for _, l := range n.listeners {
+		input := &elbv2.ModifyListenerInput{
+			ListenerArn: l.ListenerArn,
+			DefaultActions: []*elbv2.Action{
+				{
+					TargetGroupArn: aws.String(targetGroupArn),
+					Type:           aws.String("forward"),
+				},
+			},
+		}
+		_, err := svc.ModifyListener(input)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				nlbLogger.Errorf(aerr.Error())
+			} else {
+				nlbLogger.Errorf(err.Error())
+			}
+			return nil, errors.New("Could not set default action for NLB listener")
+		}
+		listeners = append(listeners, *l.ListenerArn)
+	}
+	return listeners, nil
+}
+
+func (n *NLB) getDomain() string {
+	return getEnv("LOADBALANCER_DOMAIN", n.domain)
+}
+
+func (n *NLB) getTargetGroupArn(serviceName string) (*string, error) {
+	svc := elbv2.New(session.New())
+	input := &elbv2.DescribeTargetGroupsInput{
+		Names: []*string{aws.String(serviceName)},
+	}
+
+	result, err := svc.DescribeTargetGroups(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case elbv2.ErrCodeLoadBalancerNotFoundException:
+				nlbLogger.Errorf(elbv2.ErrCodeLoadBalancerNotFoundException+": %v", aerr.Error())
+			case elbv2.ErrCodeTargetGroupNotFoundException:
+				nlbLogger.Errorf(elbv2.ErrCodeTargetGroupNotFoundException+": %v", aerr.Error())
+			default:
+				nlbLogger.Errorf(aerr.Error())
+			}
+		} else {
+			nlbLogger.Errorf(err.Error())
+		}
+		return nil, err
+	}
+	if len(result.TargetGroups) == 1 {
+		return result.TargetGroups[0].TargetGroupArn, nil
+	}
+	if len(result.TargetGroups) == 0 {
+		return nil, errors.New("No NLB target group found for service: " + serviceName)
+	}
+	return nil, errors.New("Multiple target groups found for service: " + serviceName)
+}
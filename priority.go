@@ -0,0 +1,239 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+
+	"errors"
+)
+
+// serviceTagKey is the tag ecs-deploy stores on a rule it created, so a
+// redeploy can recover the rule's existing priority instead of always
+// allocating a new one (which would waste priority slots forever as
+// rules get deleted and re-created under getHighestRule's old
+// max-plus-one scheme).
+const serviceTagKey = "ecs-deploy/service"
+
+const maxPriorityRetries = 5
+
+// allocateRulePriority returns the priority serviceName's rule should use
+// on this ALB: the priority of its existing tagged rule if one is found,
+// otherwise the lowest free priority across every listener. The tag
+// lookup reads every listener's rules one listener at a time (via
+// getRulesForAllListeners); the free-slot scan then fetches rules for
+// all listeners concurrently, since DescribeRules is per-listener.
+func (a *ALB) allocateRulePriority(serviceName string) (int64, error) {
+	existing, err := a.findRulePriorityByServiceTag(serviceName)
+	if err != nil {
+		return 0, err
+	}
+	if existing != 0 {
+		albLogger.Debugf("Recovered existing priority %d for service %s from rule tags", existing, serviceName)
+		return existing, nil
+	}
+
+	used, err := a.usedPrioritiesByListener()
+	if err != nil {
+		return 0, err
+	}
+	return lowestFreePriority(used)
+}
+
+// maxRulePriority is ELBv2's maximum allowed listener rule priority.
+const maxRulePriority = 50000
+
+// lowestFreePriority picks the lowest priority in [1, maxRulePriority]
+// not set in used. It is split out from allocateRulePriority so the
+// bitmap-scan logic can be unit tested without any AWS calls.
+func lowestFreePriority(used map[int64]bool) (int64, error) {
+	for priority := int64(1); priority <= maxRulePriority; priority++ {
+		if !used[priority] {
+			return priority, nil
+		}
+	}
+	return 0, errors.New("No free ALB rule priority found (all 50000 slots in use)")
+}
+
+// usedPrioritiesByListener fetches every rule across every listener in
+// parallel and returns the set of priorities already in use on any of
+// them (a priority must be free on every listener we intend to create
+// the rule on).
+func (a *ALB) usedPrioritiesByListener() (map[int64]bool, error) {
+	type result struct {
+		priorities []int64
+		err        error
+	}
+
+	results := make([]result, len(a.listeners))
+	var wg sync.WaitGroup
+	for i, l := range a.listeners {
+		wg.Add(1)
+		go func(i int, listenerArn string) {
+			defer wg.Done()
+			svc := elbv2.New(session.New())
+			input := &elbv2.DescribeRulesInput{ListenerArn: aws.String(listenerArn)}
+			var priorities []int64
+			c := true
+			res, err := svc.DescribeRules(input)
+			for c {
+				if err != nil {
+					results[i] = result{err: err}
+					return
+				}
+				for _, rule := range res.Rules {
+					if p, parseErr := strconv.ParseInt(*rule.Priority, 10, 64); parseErr == nil {
+						priorities = append(priorities, p)
+					}
+				}
+				if res.NextMarker == nil || len(*res.NextMarker) == 0 {
+					c = false
+				} else {
+					input.SetMarker(*res.NextMarker)
+					res, err = svc.DescribeRules(input)
+				}
+			}
+			results[i] = result{priorities: priorities}
+		}(i, *l.ListenerArn)
+	}
+	wg.Wait()
+
+	used := make(map[int64]bool)
+	for _, r := range results {
+		if r.err != nil {
+			if aerr, ok := r.err.(awserr.Error); ok {
+				albLogger.Errorf(aerr.Error())
+			} else {
+				albLogger.Errorf(r.err.Error())
+			}
+			return nil, errors.New("Could not describe alb listener rules")
+		}
+		for _, p := range r.priorities {
+			used[p] = true
+		}
+	}
+	return used, nil
+}
+
+// findRulePriorityByServiceTag looks across every listener's rules for
+// one tagged serviceTagKey=serviceName, returning its priority, or 0 if
+// none is found.
+func (a *ALB) findRulePriorityByServiceTag(serviceName string) (int64, error) {
+	if err := a.getRulesForAllListeners(); err != nil {
+		return 0, err
+	}
+
+	var ruleArns []*string
+	arnToPriority := make(map[string]int64)
+	for _, rules := range a.rules {
+		for _, r := range rules {
+			if r.RuleArn == nil || r.Priority == nil {
+				continue
+			}
+			p, err := strconv.ParseInt(*r.Priority, 10, 64)
+			if err != nil {
+				continue
+			}
+			ruleArns = append(ruleArns, r.RuleArn)
+			arnToPriority[*r.RuleArn] = p
+		}
+	}
+	if len(ruleArns) == 0 {
+		return 0, nil
+	}
+
+	svc := elbv2.New(session.New())
+	// DescribeTags accepts at most 20 resource ARNs per call.
+	for start := 0; start < len(ruleArns); start += 20 {
+		end := start + 20
+		if end > len(ruleArns) {
+			end = len(ruleArns)
+		}
+		result, err := svc.DescribeTags(&elbv2.DescribeTagsInput{ResourceArns: ruleArns[start:end]})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				albLogger.Errorf(aerr.Error())
+			} else {
+				albLogger.Errorf(err.Error())
+			}
+			return 0, errors.New("Could not describe tags for alb rules")
+		}
+		for _, td := range result.TagDescriptions {
+			if td.ResourceArn == nil {
+				continue
+			}
+			for _, t := range td.Tags {
+				if t.Key != nil && *t.Key == serviceTagKey && t.Value != nil && *t.Value == serviceName {
+					return arnToPriority[*td.ResourceArn], nil
+				}
+			}
+		}
+	}
+	return 0, nil
+}
+
+// createRuleForService allocates a priority for serviceName (recovering
+// its existing one if this is a redeploy), creates the rule, and tags it
+// with serviceTagKey so future deploys can recover the same priority. On
+// ErrCodePriorityInUseException - a concurrent deploy of another service
+// raced us for the same free slot - it re-allocates and retries with a
+// small jitter rather than failing the deploy.
+func (a *ALB) createRuleForService(serviceName string, ruleType string, listenerArn string, targetGroupArn string, rules []string) (int64, error) {
+	for attempt := 0; attempt < maxPriorityRetries; attempt++ {
+		priority, err := a.allocateRulePriority(serviceName)
+		if err != nil {
+			return 0, err
+		}
+
+		err = a.createRule(ruleType, listenerArn, targetGroupArn, rules, priority)
+		if err == nil {
+			if tagErr := a.tagRuleForService(listenerArn, priority, serviceName); tagErr != nil {
+				return 0, tagErr
+			}
+			return priority, nil
+		}
+
+		if err == errPriorityInUse {
+			jitter := time.Duration(rand.Intn(250)) * time.Millisecond
+			albLogger.Debugf("Priority %d for service %s raced by a concurrent deploy, retrying in %v", priority, serviceName, jitter)
+			time.Sleep(jitter)
+			continue
+		}
+		return 0, err
+	}
+	return 0, errors.New("Could not allocate a free ALB rule priority for service " + serviceName + " after " + strconv.Itoa(maxPriorityRetries) + " attempts")
+}
+
+// tagRuleForService stamps the rule at priority on listenerArn with
+// serviceTagKey=serviceName.
+func (a *ALB) tagRuleForService(listenerArn string, priority int64, serviceName string) error {
+	rule, err := a.describeRuleAtPriority(listenerArn, priority)
+	if err != nil {
+		return err
+	}
+	if rule == nil || rule.RuleArn == nil {
+		return errors.New("Could not find created rule at priority " + strconv.FormatInt(priority, 10) + " to tag")
+	}
+	svc := elbv2.New(session.New())
+	_, err = svc.AddTags(&elbv2.AddTagsInput{
+		ResourceArns: []*string{rule.RuleArn},
+		Tags: []*elbv2.Tag{
+			{Key: aws.String(serviceTagKey), Value: aws.String(serviceName)},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			albLogger.Errorf(aerr.Error())
+		} else {
+			albLogger.Errorf(err.Error())
+		}
+		return errors.New("Could not tag alb rule with service name")
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestLowestFreePriorityPicksGap(t *testing.T) {
+	used := map[int64]bool{1: true, 2: true, 4: true}
+	priority, err := lowestFreePriority(used)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if priority != 3 {
+		t.Fatalf("expected priority 3, got %d", priority)
+	}
+}
+
+func TestLowestFreePriorityEmptyBitmapStartsAtOne(t *testing.T) {
+	priority, err := lowestFreePriority(map[int64]bool{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if priority != 1 {
+		t.Fatalf("expected priority 1, got %d", priority)
+	}
+}
+
+func TestLowestFreePriorityAllUsedReturnsError(t *testing.T) {
+	used := make(map[int64]bool, maxRulePriority)
+	for i := int64(1); i <= maxRulePriority; i++ {
+		used[i] = true
+	}
+	if _, err := lowestFreePriority(used); err == nil {
+		t.Fatal("expected an error when every priority slot is in use")
+	}
+}
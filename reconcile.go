@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+// configHashTagKey is the tag ecs-deploy stores on target groups and
+// rules it manages, so a redeploy can tell whether the desired
+// configuration changed instead of blindly re-creating resources.
+const configHashTagKey = "ecs-deploy/config-hash"
+
+// targetGroupFingerprint computes a deterministic fingerprint of the
+// target group configuration a Deploy describes, so two deploys with an
+// identical port/protocol/health-check converge to the same hash.
+func targetGroupFingerprint(serviceName string, d Deploy) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "name=%s\n", serviceName)
+	fmt.Fprintf(h, "port=%d\n", d.ServicePort)
+	fmt.Fprintf(h, "protocol=%s\n", d.ServiceProtocol)
+	fmt.Fprintf(h, "targetType=%s\n", d.TargetType)
+	fmt.Fprintf(h, "hc.healthyThreshold=%d\n", d.HealthCheck.HealthyThreshold)
+	fmt.Fprintf(h, "hc.unhealthyThreshold=%d\n", d.HealthCheck.UnhealthyThreshold)
+	fmt.Fprintf(h, "hc.path=%s\n", d.HealthCheck.Path)
+	fmt.Fprintf(h, "hc.port=%s\n", d.HealthCheck.Port)
+	fmt.Fprintf(h, "hc.protocol=%s\n", d.HealthCheck.Protocol)
+	fmt.Fprintf(h, "hc.interval=%d\n", d.HealthCheck.Interval)
+	fmt.Fprintf(h, "hc.matcher=%s\n", d.HealthCheck.Matcher)
+	fmt.Fprintf(h, "hc.timeout=%d\n", d.HealthCheck.Timeout)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ruleFingerprint computes a deterministic fingerprint of a listener
+// rule's target and conditions.
+func ruleFingerprint(ruleType string, targetGroupArn string, rules []string) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "ruleType=%s\n", ruleType)
+	fmt.Fprintf(h, "targetGroupArn=%s\n", targetGroupArn)
+	for _, r := range rules {
+		fmt.Fprintf(h, "rule=%s\n", r)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// describeConfigHash reads the configHashTagKey tag off an ELBv2 resource
+// (target group or rule ARN). It returns the empty string if the
+// resource has no such tag.
+func describeConfigHash(resourceArn string) (string, error) {
+	svc := elbv2.New(session.New())
+	result, err := svc.DescribeTags(&elbv2.DescribeTagsInput{
+		ResourceArns: []*string{aws.String(resourceArn)},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			albLogger.Errorf(aerr.Error())
+		} else {
+			albLogger.Errorf(err.Error())
+		}
+		return "", errors.New("Could not describe tags for " + resourceArn)
+	}
+	for _, td := range result.TagDescriptions {
+		for _, t := range td.Tags {
+			if t.Key != nil && *t.Key == configHashTagKey {
+				if t.Value != nil {
+					return *t.Value, nil
+				}
+				return "", nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// tagConfigHash stamps a resource with its desired-config fingerprint.
+func tagConfigHash(resourceArn string, hash string) error {
+	svc := elbv2.New(session.New())
+	_, err := svc.AddTags(&elbv2.AddTagsInput{
+		ResourceArns: []*string{aws.String(resourceArn)},
+		Tags: []*elbv2.Tag{
+			{
+				Key:   aws.String(configHashTagKey),
+				Value: aws.String(hash),
+			},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			albLogger.Errorf(aerr.Error())
+		} else {
+			albLogger.Errorf(err.Error())
+		}
+		return errors.New("Could not tag " + resourceArn + " with config hash")
+	}
+	return nil
+}
+
+// isTargetGroupNotFound reports whether err from getTargetGroupArn means
+// "no target group exists yet", as opposed to a transient AWS error
+// (throttling, auth, network) that happens not to carry a target group.
+// getTargetGroupArn returns either the raw AWS error (which carries
+// ErrCodeTargetGroupNotFoundException when DescribeTargetGroups can't
+// find the name) or its own "No ALB target group found" error when AWS
+// returns zero results for a valid call.
+func isTargetGroupNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == elbv2.ErrCodeTargetGroupNotFoundException
+	}
+	return strings.HasPrefix(err.Error(), "No ALB target group found for service")
+}
+
+// reconcileTargetGroup makes the target group for serviceName match d,
+// creating it if it does not exist yet. If it exists and its stored
+// config-hash tag matches the fingerprint of d, this is a no-op; if the
+// hash differs, the target group's health check settings are modified in
+// place instead of recreated (see modifyTargetGroup) and the new hash is
+// stored. Target group attributes are not modified.
+func (a *ALB) reconcileTargetGroup(serviceName string, d Deploy) (*string, error) {
+	desiredHash := targetGroupFingerprint(serviceName, d)
+
+	targetGroupArn, err := a.getTargetGroupArn(serviceName)
+	if err != nil {
+		if !isTargetGroupNotFound(err) {
+			return nil, err
+		}
+		// no existing target group: create one from scratch
+		targetGroupArn, err = a.createTargetGroup(serviceName, d)
+		if err != nil {
+			return nil, err
+		}
+		if err := tagConfigHash(*targetGroupArn, desiredHash); err != nil {
+			return nil, err
+		}
+		return targetGroupArn, nil
+	}
+
+	currentHash, err := describeConfigHash(*targetGroupArn)
+	if err != nil {
+		return nil, err
+	}
+	if currentHash == desiredHash {
+		albLogger.Debugf("Target group %s config unchanged (hash %s), skipping modify", serviceName, desiredHash)
+		return targetGroupArn, nil
+	}
+
+	albLogger.Infof("Target group %s config hash changed (%s -> %s), modifying", serviceName, currentHash, desiredHash)
+	if err := a.modifyTargetGroup(*targetGroupArn, d); err != nil {
+		return nil, err
+	}
+	if err := tagConfigHash(*targetGroupArn, desiredHash); err != nil {
+		return nil, err
+	}
+	return targetGroupArn, nil
+}
+
+// modifyTargetGroup converges an existing target group's health check
+// settings to match d. Port, protocol and VpcId cannot be changed on an
+// existing target group, so those are left untouched.
+func (a *ALB) modifyTargetGroup(targetGroupArn string, d Deploy) error {
+	svc := elbv2.New(session.New())
+	input := &elbv2.ModifyTargetGroupInput{TargetGroupArn: aws.String(targetGroupArn)}
+	if d.HealthCheck.HealthyThreshold != 0 {
+		input.SetHealthyThresholdCount(d.HealthCheck.HealthyThreshold)
+	}
+	if d.HealthCheck.UnhealthyThreshold != 0 {
+		input.SetUnhealthyThresholdCount(d.HealthCheck.UnhealthyThreshold)
+	}
+	if d.HealthCheck.Path != "" {
+		input.SetHealthCheckPath(d.HealthCheck.Path)
+	}
+	if d.HealthCheck.Port != "" {
+		input.SetHealthCheckPort(d.HealthCheck.Port)
+	}
+	if d.HealthCheck.Protocol != "" {
+		input.SetHealthCheckProtocol(d.HealthCheck.Protocol)
+	}
+	if d.HealthCheck.Interval != 0 {
+		input.SetHealthCheckIntervalSeconds(d.HealthCheck.Interval)
+	}
+	if d.HealthCheck.Matcher != "" {
+		input.SetMatcher(&elbv2.Matcher{HttpCode: aws.String(d.HealthCheck.Matcher)})
+	}
+	if d.HealthCheck.Timeout > 0 {
+		input.SetHealthCheckTimeoutSeconds(d.HealthCheck.Timeout)
+	}
+
+	_, err := svc.ModifyTargetGroup(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case elbv2.ErrCodeTargetGroupNotFoundException:
+				albLogger.Errorf(elbv2.ErrCodeTargetGroupNotFoundException+": %v", aerr.Error())
+			case elbv2.ErrCodeInvalidConfigurationRequestException:
+				albLogger.Errorf(elbv2.ErrCodeInvalidConfigurationRequestException+": %v", aerr.Error())
+			default:
+				albLogger.Errorf(aerr.Error())
+			}
+		} else {
+			albLogger.Errorf(err.Error())
+		}
+		return errors.New("Could not modify target group")
+	}
+	return nil
+}
+
+// reconcileRule makes the rule for (ruleType, rules) on listenerArn
+// forward to targetGroupArn, creating it at priority if none exists yet.
+// If a rule already occupies priority with a matching config-hash tag,
+// this is treated as a no-op; if the hash differs, the existing rule's
+// conditions and actions are modified in place rather than recreated,
+// which avoids PriorityInUseException churn on redeploy.
+func (a *ALB) reconcileRule(ruleType string, listenerArn string, targetGroupArn string, rules []string, priority int64) error {
+	desiredHash := ruleFingerprint(ruleType, targetGroupArn, rules)
+
+	svc := elbv2.New(session.New())
+	existing, err := a.describeRuleAtPriority(listenerArn, priority)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		if err := a.createRule(ruleType, listenerArn, targetGroupArn, rules, priority); err != nil {
+			return err
+		}
+		existing, err = a.describeRuleAtPriority(listenerArn, priority)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return errors.New("Could not find newly created rule at priority " + strconv.FormatInt(priority, 10))
+		}
+		return tagConfigHash(*existing.RuleArn, desiredHash)
+	}
+
+	currentHash, err := describeConfigHash(*existing.RuleArn)
+	if err != nil {
+		return err
+	}
+	if currentHash == desiredHash {
+		albLogger.Debugf("Rule at priority %d config unchanged (hash %s), skipping modify", priority, desiredHash)
+		return nil
+	}
+
+	albLogger.Infof("Rule at priority %d config hash changed (%s -> %s), modifying", priority, currentHash, desiredHash)
+	conditions, err := conditionsForRule(ruleType, rules, a.getDomain())
+	if err != nil {
+		return err
+	}
+	_, err = svc.ModifyRule(&elbv2.ModifyRuleInput{
+		RuleArn:    existing.RuleArn,
+		Conditions: conditions,
+		Actions: []*elbv2.Action{
+			{
+				TargetGroupArn: aws.String(targetGroupArn),
+				Type:           aws.String("forward"),
+			},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			albLogger.Errorf(aerr.Error())
+		} else {
+			albLogger.Errorf(err.Error())
+		}
+		return errors.New("Could not modify alb rule")
+	}
+	return tagConfigHash(*existing.RuleArn, desiredHash)
+}
+
+// describeRuleAtPriority returns the rule currently occupying priority
+// on listenerArn, or nil if the priority is free.
+func (a *ALB) describeRuleAtPriority(listenerArn string, priority int64) (*elbv2.Rule, error) {
+	svc := elbv2.New(session.New())
+	input := &elbv2.DescribeRulesInput{ListenerArn: aws.String(listenerArn)}
+	c := true
+	result, err := svc.DescribeRules(input)
+	for c {
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				albLogger.Errorf(aerr.Error())
+			} else {
+				albLogger.Errorf(err.Error())
+			}
+			return nil, errors.New("Could not describe alb listener rules")
+		}
+		for _, rule := range result.Rules {
+			if i, _ := strconv.ParseInt(*rule.Priority, 10, 64); i == priority {
+				return rule, nil
+			}
+		}
+		if result.NextMarker == nil || len(*result.NextMarker) == 0 {
+			c = false
+		} else {
+			input.SetMarker(*result.NextMarker)
+			result, err = svc.DescribeRules(input)
+		}
+	}
+	return nil, nil
+}
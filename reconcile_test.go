@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTargetGroupFingerprintDeterministic(t *testing.T) {
+	d := Deploy{
+		ServicePort:     8080,
+		ServiceProtocol: "HTTP",
+		HealthCheck:     HealthCheck{Path: "/healthz", Interval: 30},
+	}
+	a := targetGroupFingerprint("my-service", d)
+	b := targetGroupFingerprint("my-service", d)
+	if a != b {
+		t.Fatalf("expected identical fingerprints for identical input, got %q != %q", a, b)
+	}
+}
+
+func TestTargetGroupFingerprintChangesWithConfig(t *testing.T) {
+	base := Deploy{ServicePort: 8080, ServiceProtocol: "HTTP"}
+	changed := base
+	changed.ServicePort = 9090
+
+	if targetGroupFingerprint("my-service", base) == targetGroupFingerprint("my-service", changed) {
+		t.Fatal("expected fingerprint to change when ServicePort changes")
+	}
+	if targetGroupFingerprint("my-service", base) == targetGroupFingerprint("other-service", base) {
+		t.Fatal("expected fingerprint to change when service name changes")
+	}
+}
+
+func TestRuleFingerprintDeterministic(t *testing.T) {
+	a := ruleFingerprint("hostname", "arn:tg-1", []string{"foo"})
+	b := ruleFingerprint("hostname", "arn:tg-1", []string{"foo"})
+	if a != b {
+		t.Fatalf("expected identical fingerprints for identical input, got %q != %q", a, b)
+	}
+	if a == ruleFingerprint("hostname", "arn:tg-2", []string{"foo"}) {
+		t.Fatal("expected fingerprint to change when targetGroupArn changes")
+	}
+	if a == ruleFingerprint("hostname", "arn:tg-1", []string{"bar"}) {
+		t.Fatal("expected fingerprint to change when rules change")
+	}
+}
+
+func TestIsTargetGroupNotFound(t *testing.T) {
+	notFound := errors.New("No ALB target group found for service: my-service")
+	if !isTargetGroupNotFound(notFound) {
+		t.Fatal("expected the not-found sentinel message to be recognized as not-found")
+	}
+
+	multiple := errors.New("Multiple target groups found for service: my-service")
+	if isTargetGroupNotFound(multiple) {
+		t.Fatal("did not expect an ambiguous multiple-match error to be treated as not-found")
+	}
+
+	transient := errors.New("RequestError: send request failed")
+	if isTargetGroupNotFound(transient) {
+		t.Fatal("did not expect a transient/unrelated error to be treated as not-found")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+
+	"errors"
+)
+
+// defaultCanarySteps is the traffic-weight schedule ALB.rollout steps the
+// green target group through when the caller doesn't supply its own.
+var defaultCanarySteps = []int64{10, 50, 100}
+
+// greenTargetGroupName is the name ALB.rollout gives the new target group
+// it stands up for a blue-green or canary deploy, so it never collides
+// with serviceName's existing ("blue") target group.
+func greenTargetGroupName(serviceName string) string {
+	return serviceName + "-green"
+}
+
+// rollout is the orchestration entry point for Deploy.Strategy: for
+// "blue-green" and "canary" it stands up a second ("green") target group
+// for serviceName, reconciles it to d, and shifts traffic onto it via
+// shiftTraffic in the weights given by steps (e.g. 10 -> 50 -> 100),
+// deregistering the old ("blue") target group once green is serving
+// 100%. For "rolling" (the default) or when serviceName has no existing
+// target group yet, it just reconciles serviceName's target group
+// directly, since there is nothing to shift traffic away from.
+//
+// rollout only covers the ALB-side of a blue-green/canary deploy
+// (target groups and rule weights); registering a new ECS task set
+// against the green target group is the caller's responsibility, done
+// before calling rollout so the green target group already has healthy
+// targets by the time traffic starts shifting onto it.
+func (a *ALB) rollout(serviceName string, d Deploy, steps []int64) (*string, error) {
+	if d.Strategy != StrategyBlueGreen && d.Strategy != StrategyCanary {
+		return a.reconcileTargetGroup(serviceName, d)
+	}
+
+	blueArn, err := a.getTargetGroupArn(serviceName)
+	if err != nil {
+		if !isTargetGroupNotFound(err) {
+			return nil, err
+		}
+		// first deploy for this service: nothing to shift traffic from yet.
+		return a.reconcileTargetGroup(serviceName, d)
+	}
+
+	if len(steps) == 0 {
+		steps = defaultCanarySteps
+	}
+
+	greenArn, err := a.reconcileTargetGroup(greenTargetGroupName(serviceName), d)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, weight := range steps {
+		weights := map[string]int64{*blueArn: 100 - weight, *greenArn: weight}
+		if err := a.shiftTraffic(serviceName, weights); err != nil {
+			return nil, err
+		}
+		albLogger.Infof("Rollout for %s (%s): shifted %d%% traffic to green target group %s", serviceName, d.Strategy, weight, *greenArn)
+	}
+
+	if err := a.deleteTargetGroup(*blueArn); err != nil {
+		return nil, err
+	}
+	return greenArn, nil
+}
+
+// deleteTargetGroup deletes the target group at targetGroupArn, e.g. the
+// old ("blue") target group once ALB.rollout has fully shifted traffic
+// off it.
+func (a *ALB) deleteTargetGroup(targetGroupArn string) error {
+	svc := elbv2.New(session.New())
+	_, err := svc.DeleteTargetGroup(&elbv2.DeleteTargetGroupInput{TargetGroupArn: aws.String(targetGroupArn)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case elbv2.ErrCodeTargetGroupNotFoundException:
+				albLogger.Errorf(elbv2.ErrCodeTargetGroupNotFoundException+": %v", aerr.Error())
+			case elbv2.ErrCodeResourceInUseException:
+				albLogger.Errorf(elbv2.ErrCodeResourceInUseException+": %v", aerr.Error())
+			default:
+				albLogger.Errorf(aerr.Error())
+			}
+		} else {
+			albLogger.Errorf(err.Error())
+		}
+		return errors.New("Could not delete target group " + targetGroupArn)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+package main
+
+import "testing"
+
+func TestGreenTargetGroupName(t *testing.T) {
+	if got := greenTargetGroupName("my-service"); got != "my-service-green" {
+		t.Fatalf("expected my-service-green, got %s", got)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+
+	"errors"
+)
+
+// RuleCondition is a structured listener rule condition, covering the
+// ELBv2 condition fields beyond the plain path-pattern/host-header pair
+// that createRule's ruleType strings handle: http-header,
+// http-request-method, query-string and source-ip.
+type RuleCondition struct {
+	// Field is one of "path-pattern", "host-header", "http-header",
+	// "http-request-method", "query-string" or "source-ip".
+	Field string
+	// Values holds the condition values for every field except
+	// query-string, e.g. the header value(s) for http-header, the
+	// method name(s) for http-request-method, the CIDR(s) for
+	// source-ip.
+	Values []string
+	// HeaderName is required when Field is "http-header".
+	HeaderName string
+	// KeyValuePairs is used when Field is "query-string"; an empty Key
+	// matches the value against any query string key.
+	KeyValuePairs map[string]string
+}
+
+// buildRuleCondition converts a RuleCondition into the elbv2 API shape.
+// domain is used to qualify bare hostnames into a FQDN for host-header
+// conditions, as with LOADBALANCER_DOMAIN.
+func buildRuleCondition(c RuleCondition, domain string) (*elbv2.RuleCondition, error) {
+	switch c.Field {
+	case "path-pattern":
+		return &elbv2.RuleCondition{
+			Field:  aws.String("path-pattern"),
+			Values: aws.StringSlice(c.Values),
+		}, nil
+	case "host-header":
+		if len(c.Values) != 1 {
+			return nil, errors.New("host-header condition requires exactly 1 value")
+		}
+		hostname := qualifyHostname(c.Values[0], domain)
+		return &elbv2.RuleCondition{
+			Field:  aws.String("host-header"),
+			Values: []*string{aws.String(hostname)},
+		}, nil
+	case "http-header":
+		if c.HeaderName == "" {
+			return nil, errors.New("http-header condition requires HeaderName")
+		}
+		return &elbv2.RuleCondition{
+			Field: aws.String("http-header"),
+			HttpHeaderConfig: &elbv2.HttpHeaderConditionConfig{
+				HttpHeaderName: aws.String(c.HeaderName),
+				Values:         aws.StringSlice(c.Values),
+			},
+		}, nil
+	case "http-request-method":
+		return &elbv2.RuleCondition{
+			Field: aws.String("http-request-method"),
+			HttpRequestMethodConfig: &elbv2.HttpRequestMethodConditionConfig{
+				Values: aws.StringSlice(c.Values),
+			},
+		}, nil
+	case "query-string":
+		var pairs []*elbv2.QueryStringKeyValuePair
+		for k, v := range c.KeyValuePairs {
+			pair := &elbv2.QueryStringKeyValuePair{Value: aws.String(v)}
+			if k != "" {
+				pair.Key = aws.String(k)
+			}
+			pairs = append(pairs, pair)
+		}
+		return &elbv2.RuleCondition{
+			Field: aws.String("query-string"),
+			QueryStringConfig: &elbv2.QueryStringConditionConfig{
+				Values: pairs,
+			},
+		}, nil
+	case "source-ip":
+		return &elbv2.RuleCondition{
+			Field: aws.String("source-ip"),
+			SourceIpConfig: &elbv2.SourceIpConditionConfig{
+				Values: aws.StringSlice(c.Values),
+			},
+		}, nil
+	default:
+		return nil, errors.New("rule condition field not recognized: " + c.Field)
+	}
+}
+
+// buildRuleConditions converts a slice of RuleCondition into the elbv2
+// API shape, in order.
+func buildRuleConditions(conditions []RuleCondition, domain string) ([]*elbv2.RuleCondition, error) {
+	if len(conditions) == 0 {
+		return nil, errors.New("at least one rule condition is required")
+	}
+	result := make([]*elbv2.RuleCondition, 0, len(conditions))
+	for _, c := range conditions {
+		built, err := buildRuleCondition(c, domain)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, built)
+	}
+	return result, nil
+}
+
+// createRuleForAllListenersAdvanced is the structured-condition sibling
+// of createRuleForAllListeners, for conditions createRule's ruleType
+// strings cannot express (http-header, http-request-method,
+// query-string, source-ip).
+func (a *ALB) createRuleForAllListenersAdvanced(conditions []RuleCondition, targetGroupArn string, priority int64) ([]string, error) {
+	var listeners []string
+	for _, l := range a.listeners {
+		err := a.createRuleAdvanced(*l.ListenerArn, targetGroupArn, conditions, priority)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, *l.ListenerArn)
+	}
+	return listeners, nil
+}
+
+// createRuleAdvanced is the structured-condition sibling of createRule.
+func (a *ALB) createRuleAdvanced(listenerArn string, targetGroupArn string, conditions []RuleCondition, priority int64) error {
+	svc := elbv2.New(session.New())
+	builtConditions, err := buildRuleConditions(conditions, getEnv("LOADBALANCER_DOMAIN", a.domain))
+	if err != nil {
+		return err
+	}
+	input := &elbv2.CreateRuleInput{
+		Actions: []*elbv2.Action{
+			{
+				TargetGroupArn: aws.String(targetGroupArn),
+				Type:           aws.String("forward"),
+			},
+		},
+		ListenerArn: aws.String(listenerArn),
+		Priority:    aws.Int64(priority),
+		Conditions:  builtConditions,
+	}
+
+	_, err = svc.CreateRule(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case elbv2.ErrCodePriorityInUseException:
+				albLogger.Errorf(elbv2.ErrCodePriorityInUseException+": %v", aerr.Error())
+			case elbv2.ErrCodeTooManyTargetGroupsException:
+				albLogger.Errorf(elbv2.ErrCodeTooManyTargetGroupsException+": %v", aerr.Error())
+			case elbv2.ErrCodeTooManyRulesException:
+				albLogger.Errorf(elbv2.ErrCodeTooManyRulesException+": %v", aerr.Error())
+			case elbv2.ErrCodeTargetGroupAssociationLimitException:
+				albLogger.Errorf(elbv2.ErrCodeTargetGroupAssociationLimitException+": %v", aerr.Error())
+			case elbv2.ErrCodeIncompatibleProtocolsException:
+				albLogger.Errorf(elbv2.ErrCodeIncompatibleProtocolsException+": %v", aerr.Error())
+			case elbv2.ErrCodeListenerNotFoundException:
+				albLogger.Errorf(elbv2.ErrCodeListenerNotFoundException+": %v", aerr.Error())
+			case elbv2.ErrCodeTargetGroupNotFoundException:
+				albLogger.Errorf(elbv2.ErrCodeTargetGroupNotFoundException+": %v", aerr.Error())
+			case elbv2.ErrCodeInvalidConfigurationRequestException:
+				albLogger.Errorf(elbv2.ErrCodeInvalidConfigurationRequestException+": %v", aerr.Error())
+			default:
+				albLogger.Errorf(aerr.Error())
+			}
+		} else {
+			albLogger.Errorf(err.Error())
+		}
+		return errors.New("Could not create alb rule")
+	}
+	return nil
+}
+
+// findRuleByConditions is findRule's structured-condition backend: it
+// matches a rule whose forward action targets targetGroupArn and whose
+// conditions correspond one-to-one to conditions (same fields, in any
+// order, same key/value pairs for query-string conditions, same set of
+// values for the other fields). http-header conditions are matched on
+// header name only; their values are not compared.
+func (a *ALB) findRuleByConditions(listener string, targetGroupArn string, conditions []RuleCondition) (*string, *string, error) {
+	rules, ok := a.rules[listener]
+	if !ok {
+		return nil, nil, errors.New("Listener not found in rule list")
+	}
+	for _, r := range rules {
+		if !ruleHasForwardTarget(r, targetGroupArn) {
+			continue
+		}
+		if ruleConditionsMatch(r.Conditions, conditions) {
+			return r.RuleArn, r.Priority, nil
+		}
+	}
+	return nil, nil, errors.New("Rule not found for target group " + targetGroupArn + " with the given conditions")
+}
+
+func ruleHasForwardTarget(r *elbv2.Rule, targetGroupArn string) bool {
+	for _, act := range r.Actions {
+		if act.Type != nil && *act.Type == "forward" && act.TargetGroupArn != nil && *act.TargetGroupArn == targetGroupArn {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleConditionsMatch(existing []*elbv2.RuleCondition, want []RuleCondition) bool {
+	if len(existing) != len(want) {
+		return false
+	}
+	for _, w := range want {
+		if !anyConditionMatches(existing, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func anyConditionMatches(existing []*elbv2.RuleCondition, w RuleCondition) bool {
+	for _, e := range existing {
+		if e.Field == nil || *e.Field != w.Field {
+			continue
+		}
+		switch w.Field {
+		case "http-header":
+			if e.HttpHeaderConfig != nil && e.HttpHeaderConfig.HttpHeaderName != nil && *e.HttpHeaderConfig.HttpHeaderName == w.HeaderName {
+				return true
+			}
+		case "query-string":
+			if e.QueryStringConfig != nil && queryStringPairsMatch(e.QueryStringConfig.Values, w.KeyValuePairs) {
+				return true
+			}
+		default:
+			if stringValuesMatch(e.Values, w.Values) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stringValuesMatch reports whether existing and want hold the same set
+// of values, order-insensitive (e.g. source-ip CIDRs or
+// http-request-method methods, which ELBv2 itself treats as an
+// unordered set).
+func stringValuesMatch(existing []*string, want []string) bool {
+	if len(existing) != len(want) {
+		return false
+	}
+	remaining := make([]string, len(want))
+	copy(remaining, want)
+	for _, e := range existing {
+		if e == nil {
+			return false
+		}
+		found := false
+		for i, w := range remaining {
+			if w == *e {
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// queryStringPairsMatch reports whether existing's key/value pairs are
+// exactly those in want. A pair with no key in existing is compared
+// against want's "" entry, mirroring buildRuleCondition, which leaves
+// the key unset for an empty key when building the condition.
+func queryStringPairsMatch(existing []*elbv2.QueryStringKeyValuePair, want map[string]string) bool {
+	if len(existing) != len(want) {
+		return false
+	}
+	for _, e := range existing {
+		key := ""
+		if e.Key != nil {
+			key = *e.Key
+		}
+		value := ""
+		if e.Value != nil {
+			value = *e.Value
+		}
+		wantValue, ok := want[key]
+		if !ok || wantValue != value {
+			return false
+		}
+	}
+	return true
+}
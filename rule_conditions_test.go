@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+func TestBuildRuleConditionHostHeaderQualifiesBareHostname(t *testing.T) {
+	c, err := buildRuleCondition(RuleCondition{Field: "host-header", Values: []string{"foo"}}, "example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := *c.Values[0]; got != "foo.example.com" {
+		t.Fatalf("expected foo.example.com, got %s", got)
+	}
+}
+
+func TestBuildRuleConditionHttpHeaderRequiresHeaderName(t *testing.T) {
+	if _, err := buildRuleCondition(RuleCondition{Field: "http-header", Values: []string{"v2"}}, "example.com"); err == nil {
+		t.Fatal("expected an error when HeaderName is missing")
+	}
+}
+
+func TestBuildRuleConditionQueryString(t *testing.T) {
+	c, err := buildRuleCondition(RuleCondition{Field: "query-string", KeyValuePairs: map[string]string{"beta": "true"}}, "example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(c.QueryStringConfig.Values) != 1 || *c.QueryStringConfig.Values[0].Key != "beta" || *c.QueryStringConfig.Values[0].Value != "true" {
+		t.Fatalf("unexpected query string condition: %+v", c.QueryStringConfig.Values)
+	}
+}
+
+func TestAnyConditionMatchesQueryString(t *testing.T) {
+	existing := []*elbv2.RuleCondition{
+		{
+			Field: aws.String("query-string"),
+			QueryStringConfig: &elbv2.QueryStringConditionConfig{
+				Values: []*elbv2.QueryStringKeyValuePair{
+					{Key: aws.String("beta"), Value: aws.String("true")},
+				},
+			},
+		},
+	}
+	want := RuleCondition{Field: "query-string", KeyValuePairs: map[string]string{"beta": "true"}}
+	if !anyConditionMatches(existing, want) {
+		t.Fatal("expected a matching query-string condition to match")
+	}
+
+	mismatch := RuleCondition{Field: "query-string", KeyValuePairs: map[string]string{"beta": "false"}}
+	if anyConditionMatches(existing, mismatch) {
+		t.Fatal("did not expect a query-string condition with a different value to match")
+	}
+}
+
+func TestAnyConditionMatchesHttpHeader(t *testing.T) {
+	existing := []*elbv2.RuleCondition{
+		{
+			Field: aws.String("http-header"),
+			HttpHeaderConfig: &elbv2.HttpHeaderConditionConfig{
+				HttpHeaderName: aws.String("X-Api-Version"),
+				Values:         []*string{aws.String("2")},
+			},
+		},
+	}
+	if !anyConditionMatches(existing, RuleCondition{Field: "http-header", HeaderName: "X-Api-Version"}) {
+		t.Fatal("expected matching header name to match")
+	}
+	if anyConditionMatches(existing, RuleCondition{Field: "http-header", HeaderName: "X-Other-Header"}) {
+		t.Fatal("did not expect a different header name to match")
+	}
+}
+
+func TestAnyConditionMatchesSourceIpRequiresFullSet(t *testing.T) {
+	existing := []*elbv2.RuleCondition{
+		{
+			Field:  aws.String("source-ip"),
+			Values: aws.StringSlice([]string{"1.2.3.4/32", "5.5.5.5/32"}),
+		},
+	}
+	if !anyConditionMatches(existing, RuleCondition{Field: "source-ip", Values: []string{"5.5.5.5/32", "1.2.3.4/32"}}) {
+		t.Fatal("expected the same CIDR set in a different order to match")
+	}
+	if anyConditionMatches(existing, RuleCondition{Field: "source-ip", Values: []string{"1.2.3.4/32", "9.9.9.9/32"}}) {
+		t.Fatal("did not expect a partial CIDR overlap to match")
+	}
+	if anyConditionMatches(existing, RuleCondition{Field: "source-ip", Values: []string{"1.2.3.4/32"}}) {
+		t.Fatal("did not expect a subset to match when ELBv2 requires an exact CIDR set")
+	}
+}
+
+func TestFindRuleByConditionsMatchesOnForwardTargetAndConditions(t *testing.T) {
+	a := &ALB{
+		rules: map[string][]*elbv2.Rule{
+			"listener-1": {
+				{
+					RuleArn:  aws.String("rule-arn-1"),
+					Priority: aws.String("10"),
+					Actions: []*elbv2.Action{
+						{Type: aws.String("forward"), TargetGroupArn: aws.String("tg-arn-1")},
+					},
+					Conditions: []*elbv2.RuleCondition{
+						{Field: aws.String("host-header"), Values: []*string{aws.String("foo.example.com")}},
+					},
+				},
+			},
+		},
+	}
+
+	ruleArn, priority, err := a.findRuleByConditions("listener-1", "tg-arn-1", []RuleCondition{
+		{Field: "host-header", Values: []string{"foo.example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *ruleArn != "rule-arn-1" || *priority != "10" {
+		t.Fatalf("unexpected match: arn=%v priority=%v", ruleArn, priority)
+	}
+
+	if _, _, err := a.findRuleByConditions("listener-1", "tg-arn-1", []RuleCondition{
+		{Field: "host-header", Values: []string{"bar.example.com"}},
+	}); err == nil {
+		t.Fatal("expected no match for a different host-header value")
+	}
+}
+
+func TestFindRuleDelegatesToStructuredMatcher(t *testing.T) {
+	a := &ALB{
+		rules: map[string][]*elbv2.Rule{
+			"listener-1": {
+				{
+					RuleArn:  aws.String("rule-arn-1"),
+					Priority: aws.String("5"),
+					Actions: []*elbv2.Action{
+						{Type: aws.String("forward"), TargetGroupArn: aws.String("tg-arn-1")},
+					},
+					Conditions: []*elbv2.RuleCondition{
+						{Field: aws.String("path-pattern"), Values: []*string{aws.String("/api/*")}},
+					},
+				},
+			},
+		},
+	}
+
+	ruleArn, priority, err := a.findRule("listener-1", "tg-arn-1", []string{"path-pattern"}, []string{"/api/*"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *ruleArn != "rule-arn-1" || *priority != "5" {
+		t.Fatalf("unexpected match: arn=%v priority=%v", ruleArn, priority)
+	}
+}
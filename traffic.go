@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+
+	"errors"
+	"sort"
+)
+
+// Strategy values for Deploy.Strategy.
+const (
+	StrategyRolling   = "rolling"
+	StrategyBlueGreen = "blue-green"
+	StrategyCanary    = "canary"
+)
+
+// weightedForwardAction builds a "forward" Action whose ForwardConfig
+// carries one TargetGroupTuple per entry in weights, in target-group-arn
+// order, so callers get a deterministic action across calls.
+func weightedForwardAction(weights map[string]int64) *elbv2.Action {
+	targetGroupArns := make([]string, 0, len(weights))
+	for targetGroupArn := range weights {
+		targetGroupArns = append(targetGroupArns, targetGroupArn)
+	}
+	sort.Strings(targetGroupArns)
+
+	tuples := make([]*elbv2.TargetGroupTuple, 0, len(targetGroupArns))
+	for _, targetGroupArn := range targetGroupArns {
+		tuples = append(tuples, &elbv2.TargetGroupTuple{
+			TargetGroupArn: aws.String(targetGroupArn),
+			Weight:         aws.Int64(weights[targetGroupArn]),
+		})
+	}
+	return &elbv2.Action{
+		Type: aws.String("forward"),
+		ForwardConfig: &elbv2.ForwardActionConfig{
+			TargetGroups: tuples,
+		},
+	}
+}
+
+// shiftTraffic reconciles the weights of every rule across all listeners
+// that currently forwards to serviceName's target groups, replacing the
+// single-target-group forward action with a weighted one across the
+// target group ARNs given in weights (e.g. {"old-tg-arn": 90, "new-tg-arn": 10}).
+// This is the building block for blue/green and canary rollouts: a
+// deploy registers a second "green" target group, then calls
+// shiftTraffic repeatedly with increasing weight on the green target
+// group (10 -> 50 -> 100) before deregistering the old one.
+func (a *ALB) shiftTraffic(serviceName string, weights map[string]int64) error {
+	if len(weights) == 0 {
+		return errors.New("shiftTraffic requires at least one target group weight")
+	}
+
+	if err := a.getRulesForAllListeners(); err != nil {
+		return err
+	}
+
+	action := weightedForwardAction(weights)
+	svc := elbv2.New(session.New())
+
+	for listenerArn, rules := range a.rules {
+		for _, r := range rules {
+			if !ruleForwardsToAny(r, weights) {
+				continue
+			}
+			_, err := svc.ModifyRule(&elbv2.ModifyRuleInput{
+				RuleArn: r.RuleArn,
+				Actions: []*elbv2.Action{action},
+			})
+			if err != nil {
+				if aerr, ok := err.(awserr.Error); ok {
+					switch aerr.Code() {
+					case elbv2.ErrCodeRuleNotFoundException:
+						albLogger.Errorf(elbv2.ErrCodeRuleNotFoundException+": %v", aerr.Error())
+					case elbv2.ErrCodeInvalidConfigurationRequestException:
+						albLogger.Errorf(elbv2.ErrCodeInvalidConfigurationRequestException+": %v", aerr.Error())
+					default:
+						albLogger.Errorf(aerr.Error())
+					}
+				} else {
+					albLogger.Errorf(err.Error())
+				}
+				return errors.New("Could not shift traffic for rule on listener " + listenerArn)
+			}
+			albLogger.Infof("Shifted traffic for %s rule %s to weights %+v", serviceName, *r.RuleArn, weights)
+		}
+	}
+	return nil
+}
+
+// ruleForwardsToAny reports whether r's forward action targets any of
+// the target group ARNs in weights, whether via a plain forward action
+// or an existing weighted ForwardActionConfig.
+func ruleForwardsToAny(r *elbv2.Rule, weights map[string]int64) bool {
+	for _, act := range r.Actions {
+		if act.Type == nil || *act.Type != "forward" {
+			continue
+		}
+		if act.TargetGroupArn != nil {
+			if _, ok := weights[*act.TargetGroupArn]; ok {
+				return true
+			}
+		}
+		if act.ForwardConfig != nil {
+			for _, tuple := range act.ForwardConfig.TargetGroups {
+				if tuple.TargetGroupArn != nil {
+					if _, ok := weights[*tuple.TargetGroupArn]; ok {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+func TestWeightedForwardActionIsSortedByTargetGroupArn(t *testing.T) {
+	weights := map[string]int64{
+		"arn:tg-zzz": 10,
+		"arn:tg-aaa": 90,
+		"arn:tg-mmm": 50,
+	}
+
+	// Map iteration order is randomized by the runtime, so build the
+	// action many times and make sure the tuple order never changes.
+	var first []string
+	for i := 0; i < 50; i++ {
+		action := weightedForwardAction(weights)
+		var arns []string
+		for _, tuple := range action.ForwardConfig.TargetGroups {
+			arns = append(arns, *tuple.TargetGroupArn)
+		}
+		if first == nil {
+			first = arns
+		} else {
+			for j := range arns {
+				if arns[j] != first[j] {
+					t.Fatalf("tuple order changed across calls: %v vs %v", first, arns)
+				}
+			}
+		}
+	}
+
+	want := []string{"arn:tg-aaa", "arn:tg-mmm", "arn:tg-zzz"}
+	for i, arn := range want {
+		if first[i] != arn {
+			t.Fatalf("expected sorted order %v, got %v", want, first)
+		}
+	}
+}
+
+func TestWeightedForwardActionPreservesWeights(t *testing.T) {
+	weights := map[string]int64{"arn:tg-a": 10, "arn:tg-b": 90}
+	action := weightedForwardAction(weights)
+	for _, tuple := range action.ForwardConfig.TargetGroups {
+		if *tuple.Weight != weights[*tuple.TargetGroupArn] {
+			t.Fatalf("weight mismatch for %s: got %d, want %d", *tuple.TargetGroupArn, *tuple.Weight, weights[*tuple.TargetGroupArn])
+		}
+	}
+}
+
+func TestRuleForwardsToAnyPlainForwardAction(t *testing.T) {
+	r := &elbv2.Rule{
+		Actions: []*elbv2.Action{
+			{Type: aws.String("forward"), TargetGroupArn: aws.String("arn:tg-a")},
+		},
+	}
+	if !ruleForwardsToAny(r, map[string]int64{"arn:tg-a": 100}) {
+		t.Fatal("expected a plain forward action targeting arn:tg-a to match")
+	}
+	if ruleForwardsToAny(r, map[string]int64{"arn:tg-b": 100}) {
+		t.Fatal("did not expect a forward action targeting a different target group to match")
+	}
+}
+
+func TestRuleForwardsToAnyWeightedForwardConfig(t *testing.T) {
+	r := &elbv2.Rule{
+		Actions: []*elbv2.Action{
+			{
+				Type: aws.String("forward"),
+				ForwardConfig: &elbv2.ForwardActionConfig{
+					TargetGroups: []*elbv2.TargetGroupTuple{
+						{TargetGroupArn: aws.String("arn:tg-old"), Weight: aws.Int64(90)},
+						{TargetGroupArn: aws.String("arn:tg-new"), Weight: aws.Int64(10)},
+					},
+				},
+			},
+		},
+	}
+	if !ruleForwardsToAny(r, map[string]int64{"arn:tg-new": 50}) {
+		t.Fatal("expected a weighted forward config containing arn:tg-new to match")
+	}
+	if ruleForwardsToAny(r, map[string]int64{"arn:tg-unrelated": 50}) {
+		t.Fatal("did not expect an unrelated target group to match")
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+import "os"
+
+// getEnv returns the value of the environment variable named by key, or
+// fallback if it is not set (or set to the empty string).
+func getEnv(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}